@@ -0,0 +1,267 @@
+// Package backend provides Database implementations for the sharedpw
+// package: DynamoDB (the original store), an in-memory map for tests, and
+// Redis.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/paxful/ephemera"
+)
+
+const dynamoIndex = `secret`
+
+// callTimeout bounds any single GetItem/PutItem/UpdateItem/DeleteItem call so a slow
+// Dynamo doesn't eat the caller's whole context budget.
+const callTimeout = 3 * time.Second
+
+// Dynamo is a sharedpw.Database backed by a single DynamoDB table, keyed on
+// the "secret" attribute.
+type Dynamo struct {
+	Table  string
+	Client *dynamodb.Client
+}
+
+// NewDynamo builds a Dynamo backend, reading the APPLICATION and REGION env
+// vars once at construction time instead of on every call. Defaults to
+// "sharedpw" and "us-east-1".
+func NewDynamo(ctx context.Context) (*Dynamo, error) {
+	table := "sharedpw"
+	if t, ok := os.LookupEnv("APPLICATION"); ok {
+		table = t
+	}
+	region := "us-east-1"
+	if r, ok := os.LookupEnv("REGION"); ok {
+		region = r
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("backend: could not load dynamo config: %v", err)
+	}
+	return &Dynamo{Table: table, Client: dynamodb.NewFromConfig(cfg)}, nil
+}
+
+// Put implements sharedpw.Database.
+func (d *Dynamo) Put(ctx context.Context, s sharedpw.Secret) error {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(s)
+	if err != nil {
+		return err
+	}
+	_, err = d.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(d.Table),
+	})
+	if err != nil {
+		log.Printf("| ERROR backend/dynamo Put: %v", err)
+	}
+	return err
+}
+
+// Get implements sharedpw.Database. It uses a strongly consistent GetItem
+// rather than Query, since "secret" is the table's primary key -- Reveal
+// layers its own checksum retry on top for the rare stale-replica case.
+func (d *Dynamo) Get(ctx context.Context, id string) (sharedpw.Secret, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	s := sharedpw.Secret{}
+
+	result, err := d.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			dynamoIndex: &types.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return s, err
+	}
+	if result.Item == nil {
+		return s, sharedpw.ErrNotFound
+	}
+	err = attributevalue.UnmarshalMap(result.Item, &s)
+	return s, err
+}
+
+// Delete implements sharedpw.Database.
+func (d *Dynamo) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	_, err := d.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key: map[string]types.AttributeValue{
+			dynamoIndex: &types.AttributeValueMemberS{Value: id},
+		},
+		TableName: aws.String(d.Table),
+	})
+	if err != nil {
+		log.Printf("| ERROR backend/dynamo Delete: %v", err)
+	}
+	return err
+}
+
+// IncrementViews implements sharedpw.Database with a conditional UpdateItem,
+// so concurrent reveals can't both push the same secret past maxViews.
+func (d *Dynamo) IncrementViews(ctx context.Context, id string, maxViews int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	out, err := d.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			dynamoIndex: &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("ADD views :one"),
+		ConditionExpression: aws.String("attribute_not_exists(views) OR views < :max"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: strconv.Itoa(maxViews)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	var ccfe *types.ConditionalCheckFailedException
+	if errors.As(err, &ccfe) {
+		return 0, sharedpw.ErrMaxViewsReached
+	}
+	if err != nil {
+		return 0, err
+	}
+	views, ok := out.Attributes["views"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("backend: missing views attribute after update")
+	}
+	n, err := strconv.Atoi(views.Value)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ConsumeGrant implements sharedpw.Database. It reads the current grants to
+// find recipient's index, then marks that element consumed with a
+// conditional UpdateItem guarded on the element still being recipient's and
+// still unconsumed -- so two recipients consuming their own grants
+// concurrently each get an independent, atomic update instead of racing a
+// whole-item overwrite.
+func (d *Dynamo) ConsumeGrant(ctx context.Context, id string, recipient string) (bool, error) {
+	current, err := d.Get(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	idx := -1
+	for i := range current.Grants {
+		if current.Grants[i].RecipientID == recipient {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return false, sharedpw.ErrGrantNotFound
+	}
+	if current.Grants[idx].Consumed {
+		return false, sharedpw.ErrGrantConsumed
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	grant := fmt.Sprintf("grants[%d]", idx)
+	out, err := d.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			dynamoIndex: &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String(fmt.Sprintf("SET %s.consumed = :true", grant)),
+		ConditionExpression: aws.String(fmt.Sprintf("%s.recipient_id = :rid AND %s.consumed = :false", grant, grant)),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":  &types.AttributeValueMemberBOOL{Value: true},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+			":rid":   &types.AttributeValueMemberS{Value: recipient},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var ccfe *types.ConditionalCheckFailedException
+	if errors.As(err, &ccfe) {
+		return false, sharedpw.ErrGrantConsumed
+	}
+	if err != nil {
+		return false, err
+	}
+
+	updated := sharedpw.Secret{}
+	if err := attributevalue.UnmarshalMap(out.Attributes, &updated); err != nil {
+		return false, err
+	}
+	for _, g := range updated.Grants {
+		if !g.Consumed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// revokeRetries bounds how many times RevokeGrant retries after losing a
+// race against a concurrent RevokeGrant that shifted the grants list index
+// out from under it.
+const revokeRetries = 5
+
+// RevokeGrant implements sharedpw.Database. It finds recipient's index and
+// removes that element with a conditional UpdateItem guarded on the element
+// still being recipient's, rather than overwriting the whole Grants list --
+// so it can't race a concurrent ConsumeGrant and clobber that recipient's
+// consumption. A concurrent RevokeGrant for a different recipient can shift
+// the index between the read and the write; that's retried rather than
+// surfaced as an error.
+func (d *Dynamo) RevokeGrant(ctx context.Context, id string, recipient string) error {
+	for attempt := 0; attempt < revokeRetries; attempt++ {
+		current, err := d.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		idx := -1
+		for i := range current.Grants {
+			if current.Grants[i].RecipientID == recipient {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return sharedpw.ErrGrantNotFound
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, callTimeout)
+		grant := fmt.Sprintf("grants[%d]", idx)
+		_, err = d.Client.UpdateItem(callCtx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.Table),
+			Key: map[string]types.AttributeValue{
+				dynamoIndex: &types.AttributeValueMemberS{Value: id},
+			},
+			UpdateExpression:    aws.String(fmt.Sprintf("REMOVE %s", grant)),
+			ConditionExpression: aws.String(fmt.Sprintf("%s.recipient_id = :rid", grant)),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":rid": &types.AttributeValueMemberS{Value: recipient},
+			},
+		})
+		cancel()
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("backend: RevokeGrant: too much contention on %s", id)
+}
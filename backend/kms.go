@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/paxful/ephemera"
+)
+
+// KMS wraps another Database and adds a server-side envelope encryption
+// layer over Message, Tag, Iv, PwTag, PwIv, and -- for a multi-recipient
+// secret -- every Grant's WrappedKey/PwTag/PwIv: a fresh KMS data key is
+// generated per secret, the fields are AES-GCM-encrypted with it, and only
+// the KMS-wrapped data key is stored alongside the ciphertext. This is
+// defence-in-depth on top of the client-side encryption -- it protects the
+// payload if the table itself is exfiltrated.
+type KMS struct {
+	Inner  sharedpw.Database
+	Client *kms.Client
+	KeyID  string
+}
+
+// NewKMS wraps inner with envelope encryption if KMS_KEY_ID is set, and
+// returns inner unchanged otherwise.
+func NewKMS(ctx context.Context, inner sharedpw.Database) (sharedpw.Database, error) {
+	keyID, ok := os.LookupEnv("KMS_KEY_ID")
+	if !ok {
+		return inner, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backend: could not load kms config: %v", err)
+	}
+	return &KMS{Inner: inner, Client: kms.NewFromConfig(cfg), KeyID: keyID}, nil
+}
+
+// Put implements sharedpw.Database, encrypting s before delegating to Inner.
+func (k *KMS) Put(ctx context.Context, s sharedpw.Secret) error {
+	dataKey, wrapped, err := k.generateDataKey(ctx)
+	if err != nil {
+		return err
+	}
+	if err := encryptFields(dataKey, &s); err != nil {
+		return err
+	}
+	s.EncryptedDataKey = base64.StdEncoding.EncodeToString(wrapped)
+	return k.Inner.Put(ctx, s)
+}
+
+// Get implements sharedpw.Database, decrypting the record returned by Inner.
+func (k *KMS) Get(ctx context.Context, id string) (sharedpw.Secret, error) {
+	s, err := k.Inner.Get(ctx, id)
+	if err != nil {
+		return s, err
+	}
+	if s.EncryptedDataKey == "" {
+		return s, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(s.EncryptedDataKey)
+	if err != nil {
+		return s, err
+	}
+	dataKey, err := k.decryptDataKey(ctx, wrapped)
+	if err != nil {
+		return s, err
+	}
+	if err := decryptFields(dataKey, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Delete implements sharedpw.Database.
+func (k *KMS) Delete(ctx context.Context, id string) error {
+	return k.Inner.Delete(ctx, id)
+}
+
+// IncrementViews implements sharedpw.Database. Views aren't part of the
+// encrypted payload, so this just delegates to Inner.
+func (k *KMS) IncrementViews(ctx context.Context, id string, maxViews int) (int, error) {
+	return k.Inner.IncrementViews(ctx, id, maxViews)
+}
+
+// ConsumeGrant implements sharedpw.Database. Grant consumption state isn't
+// part of the encrypted payload, so this just delegates to Inner.
+func (k *KMS) ConsumeGrant(ctx context.Context, id string, recipient string) (bool, error) {
+	return k.Inner.ConsumeGrant(ctx, id, recipient)
+}
+
+// RevokeGrant implements sharedpw.Database, delegating to Inner -- removing
+// a grant doesn't touch any encrypted field.
+func (k *KMS) RevokeGrant(ctx context.Context, id string, recipient string) error {
+	return k.Inner.RevokeGrant(ctx, id, recipient)
+}
+
+func (k *KMS) generateDataKey(ctx context.Context) (plaintext, ciphertext []byte, err error) {
+	out, err := k.Client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   &k.KeyID,
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (k *KMS) decryptDataKey(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	out, err := k.Client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: ciphertext,
+		KeyId:          &k.KeyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// encryptedFields returns pointers to every Secret field envelope encryption
+// protects -- the shared ciphertext fields plus each Grant's per-recipient
+// key material -- so encryptFields/decryptFields can loop instead of
+// repeating themselves per field.
+func encryptedFields(s *sharedpw.Secret) []*string {
+	fields := []*string{&s.Message, &s.Tag, &s.Iv, &s.PwTag, &s.PwIv}
+	for i := range s.Grants {
+		fields = append(fields, &s.Grants[i].WrappedKey, &s.Grants[i].PwTag, &s.Grants[i].PwIv)
+	}
+	return fields
+}
+
+func encryptFields(dataKey []byte, s *sharedpw.Secret) error {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	for _, f := range encryptedFields(s) {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		sealed := gcm.Seal(nonce, nonce, []byte(*f), nil)
+		*f = base64.StdEncoding.EncodeToString(sealed)
+	}
+	return nil
+}
+
+func decryptFields(dataKey []byte, s *sharedpw.Secret) error {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	for _, f := range encryptedFields(s) {
+		if *f == "" {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(*f)
+		if err != nil {
+			return err
+		}
+		nonceSize := gcm.NonceSize()
+		if len(blob) < nonceSize {
+			return errors.New("backend: ciphertext too short")
+		}
+		nonce, ciphertext := blob[:nonceSize], blob[nonceSize:]
+		plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return err
+		}
+		*f = string(plain)
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
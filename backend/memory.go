@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"sync"
+
+	"github.com/paxful/ephemera"
+)
+
+// Memory is an in-memory sharedpw.Database, useful for tests and for
+// running the service without AWS.
+type Memory struct {
+	mu    sync.Mutex
+	items map[string]sharedpw.Secret
+	views map[string]int
+}
+
+// NewMemory returns an empty Memory backend.
+func NewMemory() *Memory {
+	return &Memory{
+		items: make(map[string]sharedpw.Secret),
+		views: make(map[string]int),
+	}
+}
+
+// Put implements sharedpw.Database.
+func (m *Memory) Put(ctx context.Context, s sharedpw.Secret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[s.Secret] = s
+	return nil
+}
+
+// Get implements sharedpw.Database.
+func (m *Memory) Get(ctx context.Context, id string) (sharedpw.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.items[id]
+	if !ok {
+		return sharedpw.Secret{}, sharedpw.ErrNotFound
+	}
+	return s, nil
+}
+
+// Delete implements sharedpw.Database.
+func (m *Memory) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, id)
+	delete(m.views, id)
+	return nil
+}
+
+// IncrementViews implements sharedpw.Database.
+func (m *Memory) IncrementViews(ctx context.Context, id string, maxViews int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[id]; !ok {
+		return 0, sharedpw.ErrNotFound
+	}
+	if m.views[id] >= maxViews {
+		return 0, sharedpw.ErrMaxViewsReached
+	}
+	m.views[id]++
+	return m.views[id], nil
+}
+
+// ConsumeGrant implements sharedpw.Database. The single mutex already
+// serializing every other method makes this naturally atomic.
+func (m *Memory) ConsumeGrant(ctx context.Context, id string, recipient string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.items[id]
+	if !ok {
+		return false, sharedpw.ErrNotFound
+	}
+	idx := -1
+	for i := range s.Grants {
+		if s.Grants[i].RecipientID == recipient {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return false, sharedpw.ErrGrantNotFound
+	}
+	if s.Grants[idx].Consumed {
+		return false, sharedpw.ErrGrantConsumed
+	}
+
+	s.Grants[idx].Consumed = true
+	allConsumed := true
+	for _, g := range s.Grants {
+		if !g.Consumed {
+			allConsumed = false
+			break
+		}
+	}
+	m.items[id] = s
+	return allConsumed, nil
+}
+
+// RevokeGrant implements sharedpw.Database. The single mutex already
+// serializing every other method makes this naturally atomic.
+func (m *Memory) RevokeGrant(ctx context.Context, id string, recipient string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.items[id]
+	if !ok {
+		return sharedpw.ErrNotFound
+	}
+	kept := s.Grants[:0]
+	found := false
+	for _, g := range s.Grants {
+		if g.RecipientID == recipient {
+			found = true
+			continue
+		}
+		kept = append(kept, g)
+	}
+	if !found {
+		return sharedpw.ErrGrantNotFound
+	}
+	s.Grants = kept
+	m.items[id] = s
+	return nil
+}
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paxful/ephemera"
+)
+
+func TestMemoryPutGetDelete(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	s := sharedpw.Secret{Secret: "abc123", Message: "hello"}
+	if err := m.Put(ctx, s); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := m.Get(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Message != "hello" {
+		t.Fatalf("Get: got message %q, want %q", got.Message, "hello")
+	}
+
+	if err := m.Delete(ctx, "abc123"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := m.Get(ctx, "abc123"); err != sharedpw.ErrNotFound {
+		t.Fatalf("Get after Delete: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryGetMissing(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.Get(context.Background(), "nope"); err != sharedpw.ErrNotFound {
+		t.Fatalf("Get: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryIncrementViews(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	if err := m.Put(ctx, sharedpw.Secret{Secret: "id"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		views, err := m.IncrementViews(ctx, "id", 2)
+		if err != nil {
+			t.Fatalf("IncrementViews #%d: %v", i, err)
+		}
+		if views != i {
+			t.Fatalf("IncrementViews #%d: got %d, want %d", i, views, i)
+		}
+	}
+
+	if _, err := m.IncrementViews(ctx, "id", 2); err != sharedpw.ErrMaxViewsReached {
+		t.Fatalf("IncrementViews past max: got err %v, want ErrMaxViewsReached", err)
+	}
+}
+
+func TestMemoryConsumeGrant(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	s := sharedpw.Secret{
+		Secret: "id",
+		Grants: []sharedpw.Grant{
+			{RecipientID: "alice"},
+			{RecipientID: "bob"},
+		},
+	}
+	if err := m.Put(ctx, s); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	allConsumed, err := m.ConsumeGrant(ctx, "id", "alice")
+	if err != nil {
+		t.Fatalf("ConsumeGrant(alice): %v", err)
+	}
+	if allConsumed {
+		t.Fatal("ConsumeGrant(alice): allConsumed = true, want false (bob's grant remains)")
+	}
+
+	if _, err := m.ConsumeGrant(ctx, "id", "alice"); err != sharedpw.ErrGrantConsumed {
+		t.Fatalf("ConsumeGrant(alice) again: got err %v, want ErrGrantConsumed", err)
+	}
+
+	if _, err := m.ConsumeGrant(ctx, "id", "carol"); err != sharedpw.ErrGrantNotFound {
+		t.Fatalf("ConsumeGrant(carol): got err %v, want ErrGrantNotFound", err)
+	}
+
+	allConsumed, err = m.ConsumeGrant(ctx, "id", "bob")
+	if err != nil {
+		t.Fatalf("ConsumeGrant(bob): %v", err)
+	}
+	if !allConsumed {
+		t.Fatal("ConsumeGrant(bob): allConsumed = false, want true")
+	}
+}
@@ -0,0 +1,239 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/paxful/ephemera"
+)
+
+// watchRetries bounds how many times a WATCH-based optimistic transaction
+// is retried after losing the race to a concurrent writer on the same key.
+const watchRetries = 10
+
+// Redis is a sharedpw.Database backed by Redis, expiring keys via TTL
+// instead of Dynamo's TTL attribute.
+type Redis struct {
+	Client *redis.Client
+}
+
+// NewRedis builds a Redis backend, reading REDIS_ADDR (defaults to
+// "localhost:6379").
+func NewRedis(ctx context.Context) (*Redis, error) {
+	addr := "localhost:6379"
+	if a, ok := os.LookupEnv("REDIS_ADDR"); ok {
+		addr = a
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &Redis{Client: client}, nil
+}
+
+// Put implements sharedpw.Database.
+func (r *Redis) Put(ctx context.Context, s sharedpw.Secret) error {
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(s.Expire, 0))
+	return r.Client.Set(ctx, s.Secret, j, ttl).Err()
+}
+
+// Get implements sharedpw.Database.
+func (r *Redis) Get(ctx context.Context, id string) (sharedpw.Secret, error) {
+	s := sharedpw.Secret{}
+	j, err := r.Client.Get(ctx, id).Bytes()
+	if err == redis.Nil {
+		return s, sharedpw.ErrNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(j, &s)
+	return s, err
+}
+
+// Delete implements sharedpw.Database.
+func (r *Redis) Delete(ctx context.Context, id string) error {
+	return r.Client.Del(ctx, id, viewsKey(id)).Err()
+}
+
+// IncrementViews implements sharedpw.Database, using WATCH/MULTI so a
+// concurrent reveal can't push the count past maxViews. A lost race against
+// another writer on the same key aborts the transaction with
+// redis.TxFailedErr, not a "real" error, so that case is retried rather
+// than surfaced to the caller. Every increment also refreshes viewsKey's TTL
+// to match the secret's own Expire, so the counter expires alongside the
+// secret instead of outliving it as an unbounded leak.
+func (r *Redis) IncrementViews(ctx context.Context, id string, maxViews int) (int, error) {
+	key := viewsKey(id)
+
+	for attempt := 0; attempt < watchRetries; attempt++ {
+		var views int64
+		err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+			j, err := tx.Get(ctx, id).Bytes()
+			if err == redis.Nil {
+				return sharedpw.ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			s := sharedpw.Secret{}
+			if err := json.Unmarshal(j, &s); err != nil {
+				return err
+			}
+
+			current, err := tx.Get(ctx, key).Int64()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if current >= int64(maxViews) {
+				return sharedpw.ErrMaxViewsReached
+			}
+			ttl := time.Until(time.Unix(s.Expire, 0))
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Incr(ctx, key)
+				pipe.Expire(ctx, key, ttl)
+				return nil
+			})
+			views = current + 1
+			return err
+		}, key, id)
+		if err == nil {
+			return int(views), nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return 0, err
+	}
+	return 0, fmt.Errorf("backend: IncrementViews: too much contention on %s", key)
+}
+
+// ConsumeGrant implements sharedpw.Database, using the same WATCH/retry
+// pattern as IncrementViews: the whole Secret is re-read and re-written
+// under the watch on id, so a concurrent ConsumeGrant for a different
+// recipient aborts and retries instead of clobbering this update.
+func (r *Redis) ConsumeGrant(ctx context.Context, id string, recipient string) (bool, error) {
+	for attempt := 0; attempt < watchRetries; attempt++ {
+		var allConsumed bool
+		err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+			j, err := tx.Get(ctx, id).Bytes()
+			if err == redis.Nil {
+				return sharedpw.ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			s := sharedpw.Secret{}
+			if err := json.Unmarshal(j, &s); err != nil {
+				return err
+			}
+
+			idx := -1
+			for i := range s.Grants {
+				if s.Grants[i].RecipientID == recipient {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				return sharedpw.ErrGrantNotFound
+			}
+			if s.Grants[idx].Consumed {
+				return sharedpw.ErrGrantConsumed
+			}
+			s.Grants[idx].Consumed = true
+			allConsumed = true
+			for _, g := range s.Grants {
+				if !g.Consumed {
+					allConsumed = false
+					break
+				}
+			}
+
+			updated, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			ttl := time.Until(time.Unix(s.Expire, 0))
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, id, updated, ttl)
+				return nil
+			})
+			return err
+		}, id)
+		if err == nil {
+			return allConsumed, nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return false, err
+	}
+	return false, fmt.Errorf("backend: ConsumeGrant: too much contention on %s", id)
+}
+
+// RevokeGrant implements sharedpw.Database, using the same WATCH/retry
+// pattern as ConsumeGrant so a concurrent ConsumeGrant/RevokeGrant for a
+// different recipient aborts and retries instead of clobbering this update.
+func (r *Redis) RevokeGrant(ctx context.Context, id string, recipient string) error {
+	for attempt := 0; attempt < watchRetries; attempt++ {
+		err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+			j, err := tx.Get(ctx, id).Bytes()
+			if err == redis.Nil {
+				return sharedpw.ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			s := sharedpw.Secret{}
+			if err := json.Unmarshal(j, &s); err != nil {
+				return err
+			}
+
+			kept := s.Grants[:0]
+			found := false
+			for _, g := range s.Grants {
+				if g.RecipientID == recipient {
+					found = true
+					continue
+				}
+				kept = append(kept, g)
+			}
+			if !found {
+				return sharedpw.ErrGrantNotFound
+			}
+			s.Grants = kept
+
+			updated, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			ttl := time.Until(time.Unix(s.Expire, 0))
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, id, updated, ttl)
+				return nil
+			})
+			return err
+		}, id)
+		if err == nil {
+			return nil
+		}
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("backend: RevokeGrant: too much contention on %s", id)
+}
+
+func viewsKey(id string) string {
+	return "views:" + id
+}
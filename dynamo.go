@@ -1,37 +1,116 @@
 package sharedpw
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"log"
 	"net"
-	"os"
 	"regexp"
 	"time"
+
+	"github.com/paxful/ephemera/ratelimit"
+)
+
+// consistencyPollInterval and consistencyTimeout bound how long Reveal will
+// retry against an eventually-consistent Database before giving up. A read
+// can (rarely) return a stale replica, so we poll until the checksum lines
+// up or we time out. A missing item is not retried: getConsistent returns
+// ErrNotFound from the first Get at once.
+const (
+	consistencyPollInterval = 2 * time.Second
+	consistencyTimeout      = 10 * time.Second
 )
 
+// testChecksumHook lets tests force a checksum mismatch on a given Secret
+// without needing a Database that actually races. Nil in production.
+var testChecksumHook func(s Secret) bool
+
+// ErrNotFound is returned by a Database when no record exists for an id.
+var ErrNotFound = errors.New("no items found")
+
+// ErrMaxViewsReached is returned by IncrementViews once a secret has
+// already been viewed MaxViews times.
+var ErrMaxViewsReached = errors.New("secret already revealed max times")
+
+// ErrGrantNotFound is returned by ConsumeGrant and RevokeGrant when a
+// secret has no grant for the given recipient.
+var ErrGrantNotFound = errors.New("grant not found")
+
+// ErrGrantConsumed is returned by ConsumeGrant when recipient's grant has
+// already been consumed by an earlier Reveal.
+var ErrGrantConsumed = errors.New("grant already consumed")
+
+// Database is the storage interface Save and Reveal operate through. This
+// lets the package run against DynamoDB, Redis, or an in-memory store for
+// tests -- see the backend package for implementations. Every method takes
+// a context so callers (e.g. a Lambda handler) can propagate cancellation
+// and deadlines down to the underlying calls.
+type Database interface {
+	Get(ctx context.Context, id string) (Secret, error)
+	Put(ctx context.Context, s Secret) error
+	Delete(ctx context.Context, id string) error
+
+	// IncrementViews atomically records one more view of id and returns
+	// the new view count, or ErrMaxViewsReached if id has already been
+	// viewed maxViews times.
+	IncrementViews(ctx context.Context, id string, maxViews int) (views int, err error)
+
+	// ConsumeGrant atomically marks recipient's grant on id as consumed --
+	// failing with ErrGrantNotFound or ErrGrantConsumed rather than
+	// overwriting the whole record, so two recipients consuming their
+	// grants at the same time can't clobber each other. It reports
+	// whether every grant on id is now consumed.
+	ConsumeGrant(ctx context.Context, id string, recipient string) (allConsumed bool, err error)
+
+	// RevokeGrant atomically drops recipient's grant from id, failing with
+	// ErrGrantNotFound if there is none -- without overwriting the whole
+	// record, so a RevokeGrant for one recipient can't race a concurrent
+	// ConsumeGrant for another and clobber its consumption.
+	RevokeGrant(ctx context.Context, id string, recipient string) error
+}
+
 // Secret is the structure saved to dynamo.
 // 	Secret.Secret is the index, generated by GetRandomId
 //	Expire is a unixtime value, for the Dynamo TTL
 type Secret struct {
-	Secret  string `json:"secret"`
-	Expire  int64  `json:"expire"`   // calculated by server, dynamo db removal timestamp in unixtime
-	Hours   int    `json:"hours"`    // sent by client, should be < 72
-	Message string `json:"message"`
-	Ip      string `json:"ip"`
-	HasPass bool   `json:"has_pass"`
-	Hint    string `json:"hint"`
-	Err     error  `json:"error"`
-	Tag     string `json:"tag"`
-	Iv      string `json:"iv"`
-	PwTag   string `json:"pw_tag"`
-	PwIv    string `json:"pw_iv"`
+	Secret     string `json:"secret"`
+	Expire     int64  `json:"expire"`   // calculated by server, dynamo db removal timestamp in unixtime
+	Hours      int    `json:"hours"`    // sent by client, should be < 72
+	MaxViews   int    `json:"max_views"` // sent by client, defaults to 1 (destroy-on-first-read)
+	Message    string `json:"message"`
+	MessageMd5 string `json:"message_md5"` // checksum of Message, set by Save, checked by Reveal
+	Ip         string `json:"ip"`
+	HasPass    bool   `json:"has_pass"`
+	Hint       string `json:"hint"`
+	Err        error  `json:"error"`
+	Tag        string `json:"tag"`
+	Iv         string `json:"iv"`
+	PwTag      string `json:"pw_tag"`
+	PwIv       string `json:"pw_iv"`
+
+	// EncryptedDataKey is the KMS-wrapped data key protecting Message, Tag,
+	// Iv, PwTag and PwIv at rest. Empty when server-side envelope
+	// encryption isn't configured (see backend.KMS).
+	EncryptedDataKey string `json:"encrypted_data_key,omitempty"`
+
+	// Grants, when non-empty, turns this secret into an N-of-M share:
+	// Message is a single ciphertext shared by every recipient, and each
+	// Grant carries the per-recipient wrapped key needed to decrypt it.
+	// The record is only deleted once every grant has been consumed.
+	Grants []Grant `json:"grants,omitempty"`
+}
+
+// Grant is one recipient's access to a multi-recipient Secret.
+type Grant struct {
+	RecipientID string `json:"recipient_id"`
+	WrappedKey  string `json:"wrapped_key"`
+	PwTag       string `json:"pw_tag"`
+	PwIv        string `json:"pw_iv"`
+	Consumed    bool   `json:"consumed"`
 }
 
 
@@ -73,36 +152,36 @@ func (s *Secret) ToJson() (string, error) {
 	return string(j), nil
 }
 
-// Save persistes a secret into the database
-func (s *Secret) Save(b64EncSecret string) error {
+// Save persists a secret through the given Database.
+func (s *Secret) Save(ctx context.Context, db Database, b64EncSecret string) error {
 	if s.Expire == 0 {
 		s.Expire = time.Now().UTC().Add(time.Hour * 24).Unix()
 	}
+	if s.MaxViews < 1 {
+		s.MaxViews = 1 // preserves the historical destroy-on-first-read behavior
+	}
 	s.Message = b64EncSecret
+	s.MessageMd5 = messageChecksum(s.Message)
+	return db.Put(ctx, *s)
+}
 
-	table, db, err := newClient()
-	if err != nil {
-		return err
-	}
-	j, err := dynamodbattribute.MarshalMap(s)
-	if err != nil {
-		return err
-	}
-	input := &dynamodb.PutItemInput{
-		Item:      j,
-		TableName: aws.String(table),
-	}
-	i, err := db.PutItem(input)
-	fmt.Printf("%#v\n", i)
-	if err != nil {
-		log.Printf("| ERROR dynamo.go Save: %v", err)
+// messageChecksum returns the hex-encoded MD5 of a secret's Message, stored
+// alongside it so Reveal can detect a stale or partial read.
+func messageChecksum(message string) string {
+	sum := md5.Sum([]byte(message))
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumValid reports whether s.Message matches its stored MessageMd5.
+func checksumValid(s Secret) bool {
+	if testChecksumHook != nil {
+		return testChecksumHook(s)
 	}
-	fmt.Printf("%#v\n", s)
-	return err
+	return messageChecksum(s.Message) == s.MessageMd5
 }
 
 // Revealed holds the response from a secret lookup
-type Revealed struct { 
+type Revealed struct {
 	Secret string
 	Exists bool
 	HasPass bool
@@ -111,55 +190,67 @@ type Revealed struct {
 	Iv string
 	PwTag string
 	PwIv string
+	// WrappedKey is set instead of PwTag/PwIv's single-recipient meaning
+	// when the secret came from a Grant: it's that recipient's wrapped key
+	// for the shared Secret ciphertext.
+	WrappedKey string
+	// ViewsRemaining is how many more times this secret can be revealed
+	// before it is destroyed, e.g. "2 of 3 views left".
+	ViewsRemaining int
 }
 
-// Reveal returns a base64 encoded string of the secret stored in the db, and immediately deletes it.
-func Reveal(id string, ip net.IP, reveal bool) (revealed Revealed, err error) {
-	dbIndex := `secret`
-	notHex, _ := regexp.MatchString(`\W|[g-zA-Z]`, id)
-	if len(id) != 16 || notHex {
-		return revealed, errors.New("bad id")
-	}
-	table, db, err := newClient()
-
-	// first get the secret:
-	var queryInput = &dynamodb.QueryInput{
-		TableName: aws.String(table),
-		KeyConditions: map[string]*dynamodb.Condition{
-			dbIndex: {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(id),
-					},
-				},
-			},
-		},
-	}
-	result, err := db.Query(queryInput)
-	if err != nil {
-		return revealed, err
+// Reveal returns a base64 encoded string of the secret stored in the db. A
+// single-recipient secret is deleted once it has been revealed MaxViews
+// times (MaxViews defaults to 1, so by default on first read). For a multi-recipient
+// (Grants) secret, recipient selects which grant to consume, and the record
+// is only deleted once every grant has been consumed.
+//
+// If limiter is non-nil, it's consulted before touching db at all, and a
+// bad id, an IP mismatch, or a missing/expired secret all count against ip
+// -- this is what keeps an attacker from brute-forcing the 16-hex-char id
+// space. Pass a nil limiter to skip rate limiting.
+func Reveal(ctx context.Context, db Database, limiter ratelimit.Limiter, id string, recipient string, ip net.IP, reveal bool) (revealed Revealed, err error) {
+	fail := func(failure error) (Revealed, error) {
+		if limiter != nil {
+			if rerr := limiter.RecordFailure(ctx, ip.String()); rerr != nil {
+				return revealed, rerr
+			}
+		}
+		return revealed, failure
 	}
-	r := make([]interface{}, 0)
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &r)
-	if err != nil {
-		return revealed, err
+
+	if limiter != nil {
+		allowed, lerr := limiter.Allow(ctx, ip.String())
+		if lerr != nil {
+			return revealed, lerr
+		}
+		if !allowed {
+			return revealed, errors.New("rate limited")
+		}
 	}
-	if len(r) < 1 {
-		return revealed, errors.New("no items found")
+
+	notHex, _ := regexp.MatchString(`\W|[g-zA-Z]`, id)
+	if len(id) != 16 || notHex {
+		return fail(errors.New("bad id"))
 	}
-	// marshall and unmarshal so we can get the right struct type,
-	j, err := json.Marshal(r[0])
+
+	s, err := getConsistent(ctx, db, id)
 	if err != nil {
-		return revealed, err
+		return fail(err)
 	}
-	s := &Secret{}
-	err = json.Unmarshal(j, s)
 
 	// check the IP
 	if len(s.Ip) > 0 && s.Ip != ip.String() {
 		fmt.Printf("IP Mismatch, wanted %s got %s\n", s.Ip, ip.String())
-		return revealed, errors.New("not found")
+		return fail(errors.New("not found"))
+	}
+
+	if len(s.Grants) > 0 {
+		grantRevealed, grantErr := revealGrant(ctx, db, s, recipient, reveal)
+		if grantErr != nil {
+			return fail(grantErr)
+		}
+		return grantRevealed, nil
 	}
 
 	// are we actually getting the secret, or just checking it exists?
@@ -179,20 +270,24 @@ func Reveal(id string, ip net.IP, reveal bool) (revealed Revealed, err error) {
 		return revealed, errors.New(fmt.Sprintf("could not decode secret, got %d chars and error: %v", len(secret), err))
 	}
 
-	// the secret looks okay, but make sure we can delete it before returning ...
-	delInput := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			dbIndex: {
-				S: aws.String(id),
-			},
-		},
-		TableName: aws.String(table),
+	if s.MaxViews < 1 {
+		s.MaxViews = 1
 	}
-	_, err = db.DeleteItem(delInput)
+
+	// record this view before returning it; once views hits MaxViews the
+	// record is gone, so concurrent reveals can't both succeed past it
+	views, err := db.IncrementViews(ctx, id, s.MaxViews)
 	if err != nil {
-		log.Printf("| ERROR db.go DbRemove: %v", err)
+		if err == ErrMaxViewsReached {
+			return fail(ErrNotFound)
+		}
 		return revealed, err
 	}
+	if views >= s.MaxViews {
+		if err = db.Delete(ctx, id); err != nil {
+			return revealed, err
+		}
+	}
 
 	revealed.Secret = s.Message
 	revealed.Exists = true
@@ -202,30 +297,98 @@ func Reveal(id string, ip net.IP, reveal bool) (revealed Revealed, err error) {
 	revealed.Iv = s.Iv
 	revealed.PwTag = s.PwTag
 	revealed.PwIv = s.PwIv
+	revealed.ViewsRemaining = s.MaxViews - views
 	return revealed, nil
 }
 
-// newClient returns a table name and dynamodb interface, references the
-// environ vars: TABLE and REGION, or uses sane defaults. Defaults to
-// "sharedpw" and "us-east-1" respectively.
-func newClient() (table string, db *dynamodb.DynamoDB, err error) {
-	return func() string {
-		if t, ok := os.LookupEnv("APPLICATION"); ok {
-			return t
+// revealGrant handles Reveal for a multi-recipient Secret: it atomically
+// consumes recipient's Grant via db.ConsumeGrant and only deletes the
+// record once every grant has been consumed, so other recipients can still
+// fetch the shared ciphertext. s is only used for the parts of the record
+// that never change after creation (Message, Tag, Iv, Hint, HasPass, and
+// each Grant's key material) -- consumption itself is decided by the
+// Database, not by this locally-fetched copy, so two recipients revealing
+// concurrently can't clobber each other's consumption.
+func revealGrant(ctx context.Context, db Database, s Secret, recipient string, reveal bool) (revealed Revealed, err error) {
+	idx := -1
+	for i := range s.Grants {
+		if s.Grants[i].RecipientID == recipient {
+			idx = i
+			break
 		}
-		return "sharedpw"
-	}(),
-		func() *dynamodb.DynamoDB {
-			region, ok := os.LookupEnv("REGION")
-			if !ok {
-				region = "us-east-1"
-			}
-			sess, err := session.NewSession(&aws.Config{
-				Region: aws.String(region)},
-			)
-			if err != nil {
-				log.Println("| ERROR dynamo.go newClient: did not create session")
-			}
-			return dynamodb.New(sess)
-		}(), err
+	}
+	if idx < 0 || s.Grants[idx].Consumed {
+		return revealed, ErrNotFound
+	}
+
+	if !reveal {
+		revealed.Exists = true
+		return revealed, nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(s.Message)
+	if err != nil || len(secret) == 0 {
+		return revealed, errors.New(fmt.Sprintf("could not decode secret, got %d chars and error: %v", len(secret), err))
+	}
+
+	grant := s.Grants[idx]
+
+	allConsumed, err := db.ConsumeGrant(ctx, s.Secret, recipient)
+	if err != nil {
+		if err == ErrGrantNotFound || err == ErrGrantConsumed {
+			return revealed, ErrNotFound
+		}
+		return revealed, err
+	}
+	if allConsumed {
+		if err = db.Delete(ctx, s.Secret); err != nil {
+			return revealed, err
+		}
+	}
+
+	revealed.Secret = s.Message
+	revealed.Exists = true
+	revealed.Hint = s.Hint
+	revealed.HasPass = s.HasPass
+	revealed.Tag = s.Tag
+	revealed.Iv = s.Iv
+	revealed.WrappedKey = grant.WrappedKey
+	revealed.PwTag = grant.PwTag
+	revealed.PwIv = grant.PwIv
+	return revealed, nil
+}
+
+// RevokeGrant drops recipient's access to a multi-recipient Secret without
+// invalidating any other recipient's grant. It delegates the actual removal
+// to db.RevokeGrant, the same atomic-per-grant treatment ConsumeGrant gets,
+// rather than doing a whole-record read-modify-write here.
+func RevokeGrant(ctx context.Context, db Database, id, recipient string) error {
+	return db.RevokeGrant(ctx, id, recipient)
+}
+
+// getConsistent calls db.Get, retrying for up to consistencyTimeout only
+// when its MessageMd5 doesn't match its Message -- a stale or partial
+// replica read that Dynamo's strongly consistent GetItem can still
+// occasionally hand back. ErrNotFound (or any other error) is a legitimate,
+// permanent answer -- a bad id or an already-revealed one-time secret --
+// and is returned immediately rather than retried for the full timeout.
+func getConsistent(ctx context.Context, db Database, id string) (Secret, error) {
+	deadline := time.Now().Add(consistencyTimeout)
+	for {
+		s, err := db.Get(ctx, id)
+		if err != nil {
+			return s, err
+		}
+		if checksumValid(s) {
+			return s, nil
+		}
+		if time.Now().After(deadline) {
+			return s, errors.New("checksum mismatch, giving up")
+		}
+		select {
+		case <-ctx.Done():
+			return s, ctx.Err()
+		case <-time.After(consistencyPollInterval):
+		}
+	}
 }
@@ -0,0 +1,76 @@
+package sharedpw
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stubDatabase is a minimal Database used only to drive getConsistent's
+// retry loop under testChecksumHook -- it lives here, rather than using
+// backend.Memory, so this file doesn't import backend (which imports
+// sharedpw, and would cycle).
+type stubDatabase struct {
+	secret Secret
+	gets   int
+}
+
+func (s *stubDatabase) Get(ctx context.Context, id string) (Secret, error) {
+	s.gets++
+	return s.secret, nil
+}
+
+func (s *stubDatabase) Put(ctx context.Context, secret Secret) error { return nil }
+func (s *stubDatabase) Delete(ctx context.Context, id string) error  { return nil }
+
+func (s *stubDatabase) IncrementViews(ctx context.Context, id string, maxViews int) (int, error) {
+	return 1, nil
+}
+
+func (s *stubDatabase) ConsumeGrant(ctx context.Context, id string, recipient string) (bool, error) {
+	return true, nil
+}
+
+func (s *stubDatabase) RevokeGrant(ctx context.Context, id string, recipient string) error {
+	return nil
+}
+
+func TestGetConsistentRetriesOnChecksumMismatch(t *testing.T) {
+	defer func() { testChecksumHook = nil }()
+
+	db := &stubDatabase{secret: Secret{Secret: "id", Message: "hi", MessageMd5: messageChecksum("hi")}}
+
+	failures := 1
+	testChecksumHook = func(s Secret) bool {
+		if failures > 0 {
+			failures--
+			return false
+		}
+		return true
+	}
+
+	got, err := getConsistent(context.Background(), db, "id")
+	if err != nil {
+		t.Fatalf("getConsistent: %v", err)
+	}
+	if got.Secret != "id" {
+		t.Fatalf("getConsistent: got %+v", got)
+	}
+	if db.gets != 2 {
+		t.Fatalf("getConsistent: got %d attempts, want 2 (1 failure + 1 success)", db.gets)
+	}
+}
+
+func TestGetConsistentGivesUpAfterTimeout(t *testing.T) {
+	defer func() { testChecksumHook = nil }()
+
+	db := &stubDatabase{secret: Secret{Secret: "id", Message: "hi", MessageMd5: messageChecksum("hi")}}
+	testChecksumHook = func(s Secret) bool { return false }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := getConsistent(ctx, db, "id"); err == nil {
+		t.Fatal("getConsistent: got nil error, want a timeout/cancellation error")
+	}
+}
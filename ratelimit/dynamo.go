@@ -0,0 +1,165 @@
+// Package ratelimit tracks failed Reveal attempts per requester IP so an
+// attacker can't brute-force the 16-hex-char secret id space.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const rlIndex = `secret`
+
+// callTimeout bounds any single Dynamo call made while rate limiting.
+const callTimeout = 3 * time.Second
+
+// Limiter decides whether an IP may attempt another Reveal, and records
+// failed attempts against it.
+type Limiter interface {
+	// Allow reports whether ip is still under the failure threshold.
+	Allow(ctx context.Context, ip string) (bool, error)
+	// RecordFailure counts one more failed attempt from ip.
+	RecordFailure(ctx context.Context, ip string) error
+}
+
+// Dynamo is a Limiter backed by a DynamoDB table (or a `rl#<ip>`-prefixed
+// partition of the secrets table), using an UpdateItem with ADD to count
+// attempts and a TTL attribute to expire the window automatically. The
+// UpdateItem carries no ConditionExpression: the window check is a separate
+// GetItem made just before it.
+type Dynamo struct {
+	Table       string
+	Client      *dynamodb.Client
+	MaxFailures int
+	Window      time.Duration
+}
+
+// NewDynamo builds a Dynamo rate limiter, reading the RATELIMIT_TABLE and
+// REGION env vars (defaults "sharedpw-ratelimit" and "us-east-1"). After
+// maxFailures failed reveal attempts within window, Allow returns false.
+func NewDynamo(ctx context.Context, maxFailures int, window time.Duration) (*Dynamo, error) {
+	table := "sharedpw-ratelimit"
+	if t, ok := os.LookupEnv("RATELIMIT_TABLE"); ok {
+		table = t
+	}
+	region := "us-east-1"
+	if r, ok := os.LookupEnv("REGION"); ok {
+		region = r
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: could not load dynamo config: %v", err)
+	}
+	return &Dynamo{
+		Table:       table,
+		Client:      dynamodb.NewFromConfig(cfg),
+		MaxFailures: maxFailures,
+		Window:      window,
+	}, nil
+}
+
+// Allow implements Limiter.
+func (d *Dynamo) Allow(ctx context.Context, ip string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	out, err := d.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			rlIndex: &types.AttributeValueMemberS{Value: rlKey(ip)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	if out.Item == nil || windowExpired(out.Item) {
+		return true, nil
+	}
+	attempts, ok := out.Item["attempts"].(*types.AttributeValueMemberN)
+	if !ok {
+		return true, nil
+	}
+	n, err := strconv.Atoi(attempts.Value)
+	if err != nil {
+		return false, err
+	}
+	return n < d.MaxFailures, nil
+}
+
+// RecordFailure implements Limiter. if_not_exists(expire, ...) alone would
+// only ever set expire on the first failure, so once Dynamo's TTL sweep
+// lags behind that timestamp (it can, by minutes to hours) every later
+// failure keeps ADDing to the same never-reset counter. Check the window
+// ourselves instead: an expired (or missing) record gets a fresh PutItem
+// that resets attempts to 1 and picks a new expire.
+func (d *Dynamo) RecordFailure(ctx context.Context, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	out, err := d.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			rlIndex: &types.AttributeValueMemberS{Value: rlKey(ip)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	expire := time.Now().UTC().Add(d.Window).Unix()
+
+	if out.Item == nil || windowExpired(out.Item) {
+		_, err := d.Client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.Table),
+			Item: map[string]types.AttributeValue{
+				rlIndex:    &types.AttributeValueMemberS{Value: rlKey(ip)},
+				"attempts": &types.AttributeValueMemberN{Value: "1"},
+				"expire":   &types.AttributeValueMemberN{Value: strconv.FormatInt(expire, 10)},
+			},
+		})
+		return err
+	}
+
+	_, err = d.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.Table),
+		Key: map[string]types.AttributeValue{
+			rlIndex: &types.AttributeValueMemberS{Value: rlKey(ip)},
+		},
+		UpdateExpression: aws.String("ADD attempts :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	return err
+}
+
+// windowExpired reports whether item's expire attribute is already in the
+// past. Dynamo's TTL sweep is best-effort and can lag real time by minutes
+// to hours, so Allow and RecordFailure check expire themselves rather than
+// assuming an expired record has already been swept away.
+func windowExpired(item map[string]types.AttributeValue) bool {
+	expire, ok := item["expire"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	n, err := strconv.ParseInt(expire.Value, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().UTC().Unix() >= n
+}
+
+// rlKey namespaces rate limit records so they can share a table (or
+// partition) with secrets without colliding on id.
+func rlKey(ip string) string {
+	return "rl#" + ip
+}
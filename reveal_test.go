@@ -0,0 +1,113 @@
+package sharedpw_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/paxful/ephemera"
+	"github.com/paxful/ephemera/backend"
+)
+
+func TestSaveReveal(t *testing.T) {
+	ctx := context.Background()
+	db := backend.NewMemory()
+
+	s := sharedpw.NewSecret()
+	if s.Err != nil {
+		t.Fatalf("NewSecret: %v", s.Err)
+	}
+	s.Hint = "a hint"
+	if err := s.Save(ctx, db, "c2VjcmV0"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	revealed, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "", net.ParseIP("127.0.0.1"), true)
+	if err != nil {
+		t.Fatalf("Reveal: %v", err)
+	}
+	if !revealed.Exists {
+		t.Fatal("Reveal: Exists = false, want true")
+	}
+	if revealed.Secret != "c2VjcmV0" {
+		t.Fatalf("Reveal: got secret %q, want %q", revealed.Secret, "c2VjcmV0")
+	}
+	if revealed.Hint != "a hint" {
+		t.Fatalf("Reveal: got hint %q, want %q", revealed.Hint, "a hint")
+	}
+
+	// destroy-on-first-read: a second reveal finds nothing.
+	if _, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "", net.ParseIP("127.0.0.1"), true); err != sharedpw.ErrNotFound {
+		t.Fatalf("second Reveal: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestRevealMaxViews(t *testing.T) {
+	ctx := context.Background()
+	db := backend.NewMemory()
+
+	s := sharedpw.NewSecret()
+	if s.Err != nil {
+		t.Fatalf("NewSecret: %v", s.Err)
+	}
+	s.MaxViews = 2
+	if err := s.Save(ctx, db, "c2VjcmV0"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		revealed, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "", net.ParseIP("127.0.0.1"), true)
+		if err != nil {
+			t.Fatalf("Reveal #%d: %v", i, err)
+		}
+		if revealed.ViewsRemaining != 2-i {
+			t.Fatalf("Reveal #%d: got ViewsRemaining %d, want %d", i, revealed.ViewsRemaining, 2-i)
+		}
+	}
+
+	if _, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "", net.ParseIP("127.0.0.1"), true); err != sharedpw.ErrNotFound {
+		t.Fatalf("Reveal past MaxViews: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestRevealGrantsAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	db := backend.NewMemory()
+
+	s := sharedpw.NewSecret()
+	if s.Err != nil {
+		t.Fatalf("NewSecret: %v", s.Err)
+	}
+	s.Grants = []sharedpw.Grant{
+		{RecipientID: "alice", WrappedKey: "alice-key"},
+		{RecipientID: "bob", WrappedKey: "bob-key"},
+	}
+	if err := s.Save(ctx, db, "c2VjcmV0"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	revealed, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "alice", net.ParseIP("127.0.0.1"), true)
+	if err != nil {
+		t.Fatalf("Reveal(alice): %v", err)
+	}
+	if revealed.WrappedKey != "alice-key" {
+		t.Fatalf("Reveal(alice): got WrappedKey %q, want %q", revealed.WrappedKey, "alice-key")
+	}
+
+	// alice's grant is now consumed; revealing it again finds nothing, but
+	// bob's grant -- and so the secret itself -- is untouched.
+	if _, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "alice", net.ParseIP("127.0.0.1"), true); err != sharedpw.ErrNotFound {
+		t.Fatalf("second Reveal(alice): got err %v, want ErrNotFound", err)
+	}
+
+	if err := sharedpw.RevokeGrant(ctx, db, s.Secret, "bob"); err != nil {
+		t.Fatalf("RevokeGrant(bob): %v", err)
+	}
+	if _, err := sharedpw.Reveal(ctx, db, nil, s.Secret, "bob", net.ParseIP("127.0.0.1"), true); err != sharedpw.ErrNotFound {
+		t.Fatalf("Reveal(bob) after revoke: got err %v, want ErrNotFound", err)
+	}
+
+	if err := sharedpw.RevokeGrant(ctx, db, s.Secret, "bob"); err != sharedpw.ErrGrantNotFound {
+		t.Fatalf("RevokeGrant(bob) again: got err %v, want ErrGrantNotFound", err)
+	}
+}